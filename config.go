@@ -0,0 +1,55 @@
+package logsync
+
+import (
+	"code.google.com/p/gcfg"
+)
+
+// Config describes a multi-account config file, e.g.:
+//
+//	[account "gmail"]
+//	server = imap.gmail.com:993
+//	username = me@gmail.com
+//	password = hunter2
+//	mailbox = Chats
+//	searchfrom = someone@example.com
+//	searchsince = 01-Jan-2014
+type Config struct {
+	Account map[string]*AccountConfig
+}
+
+// AccountConfig is a single [account "name"] section.
+type AccountConfig struct {
+	Server   string
+	Username string
+	Password string
+	Mailbox  string
+
+	SearchFrom    string
+	SearchTo      string
+	SearchSubject string
+	SearchSince   string
+	SearchBefore  string
+
+	// Workers bounds how many messages are processed concurrently. Zero
+	// (the default) falls back to runtime.NumCPU().
+	Workers int
+}
+
+func (a *AccountConfig) searchFilter() searchFilter {
+	return searchFilter{
+		from:    a.SearchFrom,
+		to:      a.SearchTo,
+		subject: a.SearchSubject,
+		since:   a.SearchSince,
+		before:  a.SearchBefore,
+	}
+}
+
+// LoadConfig reads a multi-account INI config file from path.
+func LoadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	if err := gcfg.ReadFileInto(cfg, path); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
@@ -3,190 +3,563 @@ package logsync
 import (
 	"bytes"
 	"code.google.com/p/go-imap/go1/imap"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"mime/multipart"
 	"net/mail"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sync"
 	"time"
 )
 
+const stateFileName = ".imapsync-state.json"
+
+// fetchWindowSize bounds how many messages a single FETCH command asks for
+// at once, so memory stays bounded regardless of mailbox size.
+const fetchWindowSize = 500
+
+// searchFilter holds optional IMAP SEARCH criteria read from an account's
+// config. A zero-value searchFilter matches every message.
+type searchFilter struct {
+	from, to, subject, since, before string
+}
+
+func (f searchFilter) empty() bool {
+	return f.from == "" && f.to == "" && f.subject == "" && f.since == "" && f.before == ""
+}
+
 type chatSyncClient struct {
-	client   *imap.Client
-	messages map[uint32]*message
-	done     chan (uint32)
+	client  *imap.Client
+	store   ChatStore
+	workers int
+	baseDir string
+}
+
+// workerCount is how many messages this client will process concurrently.
+// A non-positive chatSyncClient.workers (the default) falls back to
+// runtime.NumCPU().
+func (c *chatSyncClient) workerCount() int {
+	if c.workers > 0 {
+		return c.workers
+	}
+	return runtime.NumCPU()
 }
 
 type message struct {
-	seq     uint32
-	headers *mail.Message
-	body    *mail.Message
-	done    bool
+	seq         uint32
+	uid         uint32
+	uidValidity uint32
+	headers     *mail.Message
+	body        *mail.Message
 }
 
-func checkError(err error) {
-	if err != nil {
-		panic(err)
-	}
+// syncState is the persisted bookmark for a mailbox: the UIDVALIDITY it was
+// recorded under, and the UID up to which every message has been archived
+// (messages above it may be archived too, if a lower one failed). A mismatched
+// UIDVALIDITY means the server has renumbered the mailbox and we must
+// resync from scratch.
+type syncState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	LastUID     uint32 `json:"last_uid"`
 }
 
-func writeLog(addr, body string, date time.Time) error {
-	err := os.Mkdir(addr, 0700)
-	if err != nil && !os.IsExist(err) {
-		checkError(err)
+func loadSyncState(path string) (*syncState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &syncState{}, nil
+		}
+		return nil, err
 	}
 
-	path := fmt.Sprintf("%v/%v.html", addr, date.Format("2006-01-02.150405-0700MST"))
-	file, err := os.Create(path)
-
-	file.WriteString(body)
-	file.Sync()
+	state := &syncState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
 
-	return nil
+func (s *syncState) save(path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
 }
 
-func (m *message) process() error {
+func (m *message) process(store ChatStore) error {
 	// chat recipient
-	addrs, _ := m.headers.Header.AddressList("From")
+	addrs, err := m.headers.Header.AddressList("From")
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("seq %d: missing From header", m.seq)
+	}
 	addr := addrs[0].Address
-	//log.Printf("%d * FROM: %v", m.seq, addr)
 
 	// date
 	date, _ := m.headers.Header.Date()
 	date = date.Local()
-	//log.Printf("%d * DATE: %v", m.seq, date)
 
 	// multipart boundary
 	contentType := m.headers.Header.Get("Content-Type")
-	boundaryRegexp, _ := regexp.Compile(`boundary="(.*)"`)
-	boundary := boundaryRegexp.FindStringSubmatch(contentType)[1]
-	//log.Printf("%d * BOUNDARY: %v", m.seq, boundary)
+	boundaryRegexp := regexp.MustCompile(`boundary="(.*)"`)
+	match := boundaryRegexp.FindStringSubmatch(contentType)
+	if match == nil {
+		return fmt.Errorf("seq %d: missing boundary in Content-Type %q", m.seq, contentType)
+	}
+	boundary := match[1]
 
 	// HTML
 	mimeReader := multipart.NewReader(m.body.Body, boundary)
-	mimeReader.NextPart() // skip the XML part
-	html, _ := mimeReader.NextPart()
+	if _, err := mimeReader.NextPart(); err != nil { // skip the XML part
+		return fmt.Errorf("seq %d: reading first MIME part: %v", m.seq, err)
+	}
+	html, err := mimeReader.NextPart()
+	if err != nil {
+		return fmt.Errorf("seq %d: expected a second MIME part: %v", m.seq, err)
+	}
 	buf := new(bytes.Buffer)
 	buf.ReadFrom(html)
-	body := buf.String()
-	//log.Printf("%d * HTML: %v", m.seq, body)
+	body := buf.Bytes()
 
-	err := writeLog(addr, body, date)
-	checkError(err)
+	has, err := store.Has(addr, date)
+	if err != nil {
+		return fmt.Errorf("seq %d: checking archive: %v", m.seq, err)
+	}
+	if has {
+		return nil
+	}
+
+	if uidStore, ok := store.(uidChatStore); ok {
+		err = uidStore.StoreUID(addr, date, body, m.uid, m.uidValidity)
+	} else {
+		err = store.Store(addr, date, body)
+	}
+	if err != nil {
+		return fmt.Errorf("seq %d: writing log: %v", m.seq, err)
+	}
 
-	m.done = true
 	return nil
 }
 
-func getImapClient(server string) *chatSyncClient {
+func getImapClient(server string, store ChatStore, workers int) (*chatSyncClient, error) {
 	log.Printf("Connecting to IMAP server %v...", server)
 	client, err := imap.DialTLS(server, nil)
-	checkError(err)
+	if err != nil {
+		return nil, err
+	}
 
-	return &chatSyncClient{client, nil, make(chan uint32)}
+	return &chatSyncClient{client: client, store: store, workers: workers}, nil
 }
 
-func (c *chatSyncClient) prepare(username, password, mailbox string) {
-	err := os.Mkdir(username, 0700)
-	if err != nil && !os.IsExist(err) {
-		checkError(err)
+// prepare logs into the mailbox and scopes c.store to the account's own
+// base directory. It deliberately never calls os.Chdir: the working
+// directory is global process state, so chdir-ing into an account's
+// directory isn't safe when SyncAll is running several accounts
+// concurrently. All paths go through baseDir instead.
+func (c *chatSyncClient) prepare(username, password, mailbox string) error {
+	baseDir, err := filepath.Abs(username)
+	if err != nil {
+		return err
 	}
-
-	os.Chdir(username)
+	if err := os.MkdirAll(baseDir, 0700); err != nil {
+		return err
+	}
+	c.baseDir = baseDir
+	c.store = scopeStore(c.store, baseDir)
 
 	// If not logged in, log in
 	if c.client.State() == imap.Login {
 		log.Print("Logging in...")
-		c.client.Login(username, password)
+		if _, err := c.client.Login(username, password); err != nil {
+			return err
+		}
 	}
 
 	// Select Chats mailbox
 	log.Printf("Selecing mailbox %v...", mailbox)
-	c.client.Select(mailbox, true)
-	c.messages = make(map[uint32]*message)
-}
-
-func (c *chatSyncClient) getMessage(seq uint32) *message {
-	result, ok := c.messages[seq]
-	if !ok {
-		c.messages[seq] = &message{seq, nil, nil, false}
-		result = c.messages[seq]
+	if _, err := c.client.Select(mailbox, true); err != nil {
+		return err
 	}
-	return result
+	return nil
 }
 
-func (c *chatSyncClient) processChat(resp *imap.Response) {
+// processChat turns a single FETCH response into a message and runs it
+// through the archive pipeline, returning the UID it was fetched under
+// and whether it was actually archived (already present counts as
+// archived). A message that fails to parse or process is logged and
+// skipped rather than aborting the whole fetch, and ok is false so the
+// caller won't checkpoint past it: a transient store failure (a full
+// disk, a write error) must be retried on the next sync, not treated as
+// done.
+func (c *chatSyncClient) processChat(resp *imap.Response) (uid uint32, ok bool) {
 	msgInfo := resp.MessageInfo()
-	message := c.getMessage(msgInfo.Seq)
+	m := &message{seq: msgInfo.Seq, uidValidity: c.client.Mailbox.UIDValidity}
+
+	if uidBytes, ok := msgInfo.Attrs["UID"]; ok {
+		m.uid = imap.AsNumber(uidBytes)
+	}
 
 	headerBytes := msgInfo.Attrs["RFC822.HEADER"]
-	headers := imap.AsBytes(headerBytes)
-	message.headers, _ = mail.ReadMessage(bytes.NewReader(headers))
+	headers, err := mail.ReadMessage(bytes.NewReader(imap.AsBytes(headerBytes)))
+	if err != nil {
+		log.Printf("seq %d: skipping: parsing headers: %v", m.seq, err)
+		return m.uid, false
+	}
+	m.headers = headers
 
 	bodyBytes := msgInfo.Attrs["BODY[TEXT]"]
-	body := imap.AsBytes(bodyBytes)
-	message.body, _ = mail.ReadMessage(bytes.NewReader(body))
+	body, err := mail.ReadMessage(bytes.NewReader(imap.AsBytes(bodyBytes)))
+	if err != nil {
+		log.Printf("seq %d: skipping: parsing body: %v", m.seq, err)
+		return m.uid, false
+	}
+	m.body = body
 
-	err := message.process()
-	checkError(err)
+	if err := m.process(c.store); err != nil {
+		log.Printf("skipping message: %v", err)
+		return m.uid, false
+	}
 
-	c.done <- message.seq
+	return m.uid, true
 }
 
-func (c *chatSyncClient) syncChats() error {
-	log.Print("Starting sync...")
+// searchUIDs runs an IMAP SEARCH for the UIDs syncChats should fetch this
+// run: everything from startUID onward, narrowed by filter's criteria if
+// any are set.
+func (c *chatSyncClient) searchUIDs(startUID uint32, filter searchFilter) ([]uint32, error) {
+	terms := []imap.Field{"UID", fmt.Sprintf("%d:*", startUID)}
+	if filter.from != "" {
+		terms = append(terms, "FROM", filter.from)
+	}
+	if filter.to != "" {
+		terms = append(terms, "TO", filter.to)
+	}
+	if filter.subject != "" {
+		terms = append(terms, "SUBJECT", filter.subject)
+	}
+	if filter.since != "" {
+		terms = append(terms, "SINCE", filter.since)
+	}
+	if filter.before != "" {
+		terms = append(terms, "BEFORE", filter.before)
+	}
+
+	cmd, err := c.client.UIDSearch(terms...)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err = cmd.Result(imap.OK)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for _, resp := range cmd.Data {
+		uids = append(uids, resp.SearchResults()...)
+	}
+	return uids, nil
+}
+
+// seqSetWindows splits [startUID, endUID) into contiguous ranges of at
+// most fetchWindowSize UIDs each. If endUID is unknown (0), it falls back
+// to a single open-ended range.
+func seqSetWindows(startUID, endUID uint32) ([]*imap.SeqSet, error) {
+	if endUID == 0 || startUID >= endUID {
+		set, err := imap.NewSeqSet(fmt.Sprintf("%d:*", startUID))
+		if err != nil {
+			return nil, err
+		}
+		return []*imap.SeqSet{set}, nil
+	}
+
+	var windows []*imap.SeqSet
+	for lo := startUID; lo < endUID; lo += fetchWindowSize {
+		hi := lo + fetchWindowSize - 1
+		if hi >= endUID {
+			hi = endUID - 1
+		}
+		set, err := imap.NewSeqSet(fmt.Sprintf("%d:%d", lo, hi))
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, set)
+	}
+	return windows, nil
+}
+
+// uidSetWindows splits an explicit (possibly sparse) list of UIDs, as
+// returned by a SEARCH, into groups of at most fetchWindowSize.
+func uidSetWindows(uids []uint32) ([]*imap.SeqSet, error) {
+	var windows []*imap.SeqSet
+	for i := 0; i < len(uids); i += fetchWindowSize {
+		end := i + fetchWindowSize
+		if end > len(uids) {
+			end = len(uids)
+		}
+
+		set := new(imap.SeqSet)
+		for _, uid := range uids[i:end] {
+			set.AddNum(uid)
+		}
+		windows = append(windows, set)
+	}
+	return windows, nil
+}
+
+// fetchWindows resolves the UID windows syncChats should fetch this run.
+func (c *chatSyncClient) fetchWindows(startUID uint32, filter searchFilter) ([]*imap.SeqSet, error) {
+	if filter.empty() {
+		return seqSetWindows(startUID, c.client.Mailbox.UIDNext)
+	}
 
-	// Create SeqSet specifying all messages
-	set, err := imap.NewSeqSet("10:20")
-	checkError(err)
+	uids, err := c.searchUIDs(startUID, filter)
+	if err != nil {
+		return nil, err
+	}
+	return uidSetWindows(uids)
+}
+
+// fetchWindow runs a single bounded FETCH, handing each response to a pool
+// of workerCount() workers over a channel rather than spawning a goroutine
+// per message. It returns the highest UID it successfully archived and the
+// lowest UID that failed (0 if none did); since messages within a window
+// are processed concurrently and out of order, a failure doesn't have to
+// be on the window's last UID, so the caller can't just trust the max.
+func (c *chatSyncClient) fetchWindow(set *imap.SeqSet) (maxUID, minFailedUID uint32, err error) {
+	cmd, err := c.client.UIDFetch(set, "UID", "RFC822.HEADER", "BODY[TEXT]")
+	if err != nil {
+		return 0, 0, err
+	}
 
-	// Fetch all messages
-	cmd, err := c.client.Fetch(set, "RFC822.HEADER", "BODY[TEXT]")
-	checkError(err)
+	responses := make(chan *imap.Response, c.workerCount())
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for i := 0; i < c.workerCount(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for resp := range responses {
+				uid, ok := c.processChat(resp)
+
+				mu.Lock()
+				if ok {
+					if uid > maxUID {
+						maxUID = uid
+					}
+				} else if uid != 0 && (minFailedUID == 0 || uid < minFailedUID) {
+					minFailedUID = uid
+				}
+				mu.Unlock()
+			}
+		}()
+	}
 
 	for cmd.InProgress() {
 		c.client.Recv(-1)
 
 		for _, resp := range cmd.Data {
-			go c.processChat(resp)
+			responses <- resp
 		}
 
 		cmd.Data = nil
 	}
+	close(responses)
+	wg.Wait()
 
-	for {
-		completed := <-c.done
-		delete(c.messages, completed)
-
-		allDone := true
-		for k, _ := range c.messages {
-			if !c.messages[k].done {
-				allDone = false
-				break
-			}
+	return maxUID, minFailedUID, nil
+}
+
+// fetchAndProcess runs the header fetch in windows of fetchWindowSize
+// messages, each handled by the per-message pipeline (processChat ->
+// message.process -> ChatStore.Store), so memory stays bounded regardless
+// of mailbox size. It returns the highest UID that's safe to checkpoint,
+// or 0 if nothing matched. That's the highest UID actually archived,
+// capped below the lowest UID that failed anywhere in the run: a message
+// can't be skipped over just because some higher-numbered one in the same
+// (or a later) window happened to succeed. This is the one piece of
+// plumbing shared by one-shot syncs and the IDLE daemon.
+func (c *chatSyncClient) fetchAndProcess(windows []*imap.SeqSet) (uint32, error) {
+	var maxUID, minFailedUID uint32
+	for _, set := range windows {
+		windowMax, windowMinFailed, err := c.fetchWindow(set)
+		if err != nil {
+			return maxUID, err
+		}
+		if windowMax > maxUID {
+			maxUID = windowMax
 		}
-		if allDone {
-			break
+		if windowMinFailed != 0 && (minFailedUID == 0 || windowMinFailed < minFailedUID) {
+			minFailedUID = windowMinFailed
 		}
 	}
+	if minFailedUID != 0 && minFailedUID-1 < maxUID {
+		maxUID = minFailedUID - 1
+	}
+	return maxUID, nil
+}
+
+// syncChats fetches chats that haven't been archived yet. On the first run
+// against a mailbox (or after its UIDVALIDITY changes) it fetches every
+// message; otherwise it resumes from the UID immediately after the last one
+// it processed, using the bookmark left by a previous run. A non-empty
+// filter additionally restricts the fetch to messages matching an IMAP
+// SEARCH (FROM/TO/SUBJECT/SINCE/BEFORE).
+func (c *chatSyncClient) syncChats(filter searchFilter) error {
+	log.Print("Starting sync...")
+
+	statePath := filepath.Join(c.baseDir, stateFileName)
+	state, err := loadSyncState(statePath)
+	if err != nil {
+		return err
+	}
+
+	uidValidity := c.client.Mailbox.UIDValidity
+	startUID := state.LastUID + 1
+	if state.UIDValidity != uidValidity {
+		log.Printf("UIDVALIDITY changed (%d -> %d), doing a full resync", state.UIDValidity, uidValidity)
+		startUID = 1
+	}
+
+	windows, err := c.fetchWindows(startUID, filter)
+	if err != nil {
+		return err
+	}
+
+	maxUID, err := c.fetchAndProcess(windows)
+	if err != nil {
+		return err
+	}
+	if state.UIDValidity == uidValidity && maxUID < state.LastUID {
+		maxUID = state.LastUID
+	}
+
+	newState := &syncState{UIDValidity: uidValidity, LastUID: maxUID}
+	if err := newState.save(statePath); err != nil {
+		return err
+	}
 
 	log.Print("Processed all chats!")
 	return nil
 }
 
-func Sync(server, username, password, mailbox string) {
-	c := getImapClient(server)
+func syncAccount(a *AccountConfig, store ChatStore) error {
+	c, err := getImapClient(a.Server, store, a.Workers)
+	if err != nil {
+		return err
+	}
 	defer func() {
-		r := recover()
-		if r != nil {
-			log.Print(r)
+		log.Print("Closing client...")
+		c.client.Logout(30 * time.Second)
+	}()
+
+	if err := c.prepare(a.Username, a.Password, a.Mailbox); err != nil {
+		return err
+	}
+	return c.syncChats(a.searchFilter())
+}
+
+func Sync(server, username, password, mailbox string, store ChatStore) error {
+	return syncAccount(&AccountConfig{Server: server, Username: username, Password: password, Mailbox: mailbox}, store)
+}
+
+// idleTimeout is how long a single IDLE command is allowed to run before
+// it's torn down and reissued, well under the ~30 minute timeout most
+// servers enforce.
+const idleTimeout = 25 * time.Minute
+
+// idleOnce issues a single IDLE command, waits up to idleTimeout for the
+// server to report new messages, then terminates IDLE and, if anything
+// arrived, runs it through the normal sync pipeline.
+func (c *chatSyncClient) idleOnce(filter searchFilter) error {
+	cmd, err := c.client.Idle()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(idleTimeout)
+	sawExists := false
+	for cmd.InProgress() && !sawExists && time.Now().Before(deadline) {
+		c.client.Recv(deadline.Sub(time.Now()))
+
+		for _, resp := range cmd.Data {
+			if resp.Label == "EXISTS" {
+				sawExists = true
+			}
 		}
+		cmd.Data = nil
+	}
+
+	if _, err := c.client.IdleTerm(); err != nil {
+		return err
+	}
+
+	if !sawExists {
+		return nil
+	}
+
+	return c.syncChats(filter)
+}
+
+// SyncDaemon runs a one-shot catch-up sync and then stays connected,
+// archiving new chats as the server announces them over IMAP IDLE. It
+// only returns once a fetch or IDLE call fails outright; call it from a
+// long-running process rather than a cron job.
+func SyncDaemon(server, username, password, mailbox string, store ChatStore) error {
+	a := &AccountConfig{Server: server, Username: username, Password: password, Mailbox: mailbox}
 
+	c, err := getImapClient(a.Server, store, a.Workers)
+	if err != nil {
+		return err
+	}
+	defer func() {
 		log.Print("Closing client...")
 		c.client.Logout(30 * time.Second)
 	}()
 
-	c.prepare(username, password, mailbox)
-	c.syncChats()
+	if err := c.prepare(a.Username, a.Password, a.Mailbox); err != nil {
+		return err
+	}
+
+	filter := a.searchFilter()
+	if err := c.syncChats(filter); err != nil {
+		return err
+	}
+
+	log.Print("Entering IDLE...")
+	for {
+		if err := c.idleOnce(filter); err != nil {
+			return err
+		}
+	}
+}
+
+// SyncAll loads a multi-account config file and syncs every account
+// concurrently, returning once they've all finished. A single account's
+// failure is logged and does not stop the others.
+func SyncAll(configPath string, store ChatStore) error {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for name, account := range cfg.Account {
+		wg.Add(1)
+		go func(name string, a *AccountConfig) {
+			defer wg.Done()
+			log.Printf("Starting sync for account %q...", name)
+			if err := syncAccount(a, store); err != nil {
+				log.Printf("account %q: %v", name, err)
+			}
+		}(name, account)
+	}
+	wg.Wait()
+
+	return nil
 }
@@ -0,0 +1,64 @@
+package logsync
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// ChatStore persists archived chats and lets callers check whether a given
+// chat has already been archived, independent of the format or medium
+// underneath (flat files, a database, a Maildir, ...).
+type ChatStore interface {
+	Store(addr string, date time.Time, html []byte) error
+	Has(addr string, date time.Time) (bool, error)
+}
+
+// uidChatStore is implemented by ChatStores that also want the UID and
+// UIDVALIDITY a message was fetched under (currently just SQLiteStore).
+// message.process upgrades to it with a type assertion when available.
+type uidChatStore interface {
+	ChatStore
+	StoreUID(addr string, date time.Time, html []byte, uid, uidValidity uint32) error
+}
+
+// accountStore qualifies every addr passed to an underlying ChatStore with
+// an account's own base directory, so that concurrent accounts sharing one
+// ChatStore (as SyncAll does) can't collide with each other. This replaces
+// the old trick of os.Chdir-ing into the account's directory, which isn't
+// safe with more than one account syncing at once.
+type accountStore struct {
+	underlying ChatStore
+	baseDir    string
+}
+
+func scopeStore(store ChatStore, baseDir string) *accountStore {
+	return &accountStore{underlying: store, baseDir: baseDir}
+}
+
+// qualify confines addr to a single path component under baseDir. addr
+// comes from a message's From header, so it can't be trusted as a path:
+// filenameSafe strips separators, and the "." / ".." cases (which contain
+// no separator but still mean "parent directory" to filepath.Join) are
+// caught separately, so a crafted address can't escape baseDir.
+func (s *accountStore) qualify(addr string) string {
+	safe := filenameSafe(addr)
+	if safe == "" || safe == "." || safe == ".." {
+		safe = "_"
+	}
+	return filepath.Join(s.baseDir, safe)
+}
+
+func (s *accountStore) Store(addr string, date time.Time, html []byte) error {
+	return s.underlying.Store(s.qualify(addr), date, html)
+}
+
+func (s *accountStore) Has(addr string, date time.Time) (bool, error) {
+	return s.underlying.Has(s.qualify(addr), date)
+}
+
+func (s *accountStore) StoreUID(addr string, date time.Time, html []byte, uid, uidValidity uint32) error {
+	if u, ok := s.underlying.(uidChatStore); ok {
+		return u.StoreUID(s.qualify(addr), date, html, uid, uidValidity)
+	}
+	return s.Store(addr, date, html)
+}
@@ -0,0 +1,47 @@
+package logsync
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// FSStore archives each chat as an HTML file under <addr>/<timestamp>.html.
+// This is the on-disk layout imapsync has always used.
+type FSStore struct{}
+
+func NewFSStore() *FSStore {
+	return &FSStore{}
+}
+
+func (s *FSStore) path(addr string, date time.Time) string {
+	return fmt.Sprintf("%v/%v.html", addr, date.Format("2006-01-02.150405-0700MST"))
+}
+
+func (s *FSStore) Store(addr string, date time.Time, html []byte) error {
+	if err := os.Mkdir(addr, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	file, err := os.Create(s.path(addr, date))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(html); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (s *FSStore) Has(addr string, date time.Time) (bool, error) {
+	_, err := os.Stat(s.path(addr, date))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
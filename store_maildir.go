@@ -0,0 +1,71 @@
+package logsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// MaildirStore writes each chat into a Maildir so it can be read with mutt
+// or indexed with notmuch, rather than opened as an HTML file. Only the
+// extracted chat body reaches ChatStore.Store, so each entry is wrapped in
+// a synthetic envelope (From/Date/Content-Type) rather than being the
+// server's original RFC822 message byte-for-byte.
+type MaildirStore struct {
+	root string
+}
+
+func NewMaildirStore(root string) (*MaildirStore, error) {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &MaildirStore{root: root}, nil
+}
+
+// filenameSafe replaces path separators so a qualified addr (an accountStore
+// may pass one containing a directory prefix) can't turn into a nested
+// path when used as a single filename component.
+func filenameSafe(s string) string {
+	return strings.NewReplacer("/", "_", string(os.PathSeparator), "_").Replace(s)
+}
+
+func (s *MaildirStore) filename(addr string, date time.Time) string {
+	return fmt.Sprintf("%v.%v.imapsync", date.Format("20060102T150405"), filenameSafe(addr))
+}
+
+func (s *MaildirStore) path(addr string, date time.Time) string {
+	return filepath.Join(s.root, "cur", s.filename(addr, date))
+}
+
+func (s *MaildirStore) Store(addr string, date time.Time, html []byte) error {
+	file, err := os.Create(s.path(addr, date))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header := fmt.Sprintf("From: %s\r\nDate: %s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n",
+		addr, date.Format(time.RFC1123Z))
+	if _, err := file.WriteString(header); err != nil {
+		return err
+	}
+	if _, err := file.Write(html); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (s *MaildirStore) Has(addr string, date time.Time) (bool, error) {
+	_, err := os.Stat(s.path(addr, date))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,60 @@
+package logsync
+
+import (
+	_ "code.google.com/p/go-sqlite/go1/sqlite3"
+	"database/sql"
+	"time"
+)
+
+// SQLiteStore archives chats into a messages(addr, date, html, uid,
+// uidvalidity) table, mirroring the asgard/mimir sqlite design, so an
+// archive can be queried instead of just grepped.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS messages (
+		addr TEXT NOT NULL,
+		date DATETIME NOT NULL,
+		html BLOB NOT NULL,
+		uid INTEGER NOT NULL DEFAULT 0,
+		uidvalidity INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (addr, date)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Store(addr string, date time.Time, html []byte) error {
+	return s.StoreUID(addr, date, html, 0, 0)
+}
+
+// StoreUID is like Store but additionally records the UID and UIDVALIDITY
+// the message was fetched under. message.process uses it instead of Store
+// when the configured ChatStore supports it.
+func (s *SQLiteStore) StoreUID(addr string, date time.Time, html []byte, uid, uidValidity uint32) error {
+	_, err := s.db.Exec(
+		`INSERT OR REPLACE INTO messages (addr, date, html, uid, uidvalidity) VALUES (?, ?, ?, ?, ?)`,
+		addr, date, html, uid, uidValidity,
+	)
+	return err
+}
+
+func (s *SQLiteStore) Has(addr string, date time.Time) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE addr = ? AND date = ?`, addr, date).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}